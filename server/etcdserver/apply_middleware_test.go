@@ -0,0 +1,69 @@
+// Copyright 2022 The etcd Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package etcdserver
+
+import "testing"
+
+// orderRecordingApplierV3 wraps applierV3 without overriding any method; it
+// exists only so wrap's factories have something distinct to embed, and so
+// tests can observe nesting order via the name each factory records.
+type orderRecordingApplierV3 struct {
+	applierV3
+	name string
+}
+
+func recordingMiddleware(name string, seen *[]string) ApplierMiddlewareFactory {
+	return func(next applierV3) applierV3 {
+		*seen = append(*seen, name)
+		return &orderRecordingApplierV3{applierV3: next, name: name}
+	}
+}
+
+func TestApplierMiddlewareRegistryWrapsInRegistrationOrder(t *testing.T) {
+	var applied []string
+	r := NewApplierMiddlewareRegistry()
+	r.Register("first", recordingMiddleware("first", &applied))
+	r.Register("second", recordingMiddleware("second", &applied))
+
+	r.wrap(&fakeApplierV3{})
+
+	if len(applied) != 2 || applied[0] != "second" || applied[1] != "first" {
+		t.Fatalf("expected the last-registered middleware to be built (and so innermost-wrapped) first, got %v", applied)
+	}
+}
+
+func TestApplierMiddlewareRegistryReRegisterReplacesFactory(t *testing.T) {
+	var applied []string
+	r := NewApplierMiddlewareRegistry()
+	r.Register("only", recordingMiddleware("v1", &applied))
+	r.Register("only", recordingMiddleware("v2", &applied))
+
+	wrapped := r.wrap(&fakeApplierV3{})
+
+	if len(applied) != 1 || applied[0] != "v2" {
+		t.Fatalf("re-registering a name should replace its factory, not add a second one, got %v", applied)
+	}
+	if rec, ok := wrapped.(*orderRecordingApplierV3); !ok || rec.name != "v2" {
+		t.Fatalf("expected the replacement factory's applier to be the one returned, got %#v", wrapped)
+	}
+}
+
+func TestApplierMiddlewareRegistryNilRegistryIsNoop(t *testing.T) {
+	var r *ApplierMiddlewareRegistry
+	base := &fakeApplierV3{}
+	if wrapped := r.wrap(base); wrapped != base {
+		t.Fatalf("a nil registry should return base unwrapped, got %#v", wrapped)
+	}
+}
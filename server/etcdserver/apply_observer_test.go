@@ -0,0 +1,189 @@
+// Copyright 2022 The etcd Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package etcdserver
+
+import (
+	"errors"
+	"strconv"
+	"testing"
+
+	pb "go.etcd.io/etcd/api/v3/etcdserverpb"
+	"go.etcd.io/etcd/server/v3/storage/backend"
+	betesting "go.etcd.io/etcd/server/v3/storage/backend/testing"
+	"go.etcd.io/etcd/server/v3/storage/schema"
+	"go.uber.org/zap"
+)
+
+type fakeApplyObserver struct {
+	called int
+	err    error
+}
+
+func (f *fakeApplyObserver) Observe(r *pb.InternalRaftRequest, ar *applyResult, raftIndex, raftTerm uint64) error {
+	f.called++
+	return f.err
+}
+
+func newTestUberApplierForObservers(registry *ApplyObserverRegistry) *uberApplier {
+	return &uberApplier{
+		lg:                zap.NewNop(),
+		observers:         registry,
+		observerLastIndex: make(map[string]uint64),
+	}
+}
+
+// TestNotifyApplyObserversRequiredObserverErrorIsReturned covers only what
+// "required" actually does: the error comes back from
+// notifyApplyObservers so the caller can fold it into ar.err. By the time
+// Observe runs, dispatch has already applied the request to the backend --
+// this does not undo or block that write; see the caveat on
+// ApplyObserver.Observe.
+func TestNotifyApplyObserversRequiredObserverErrorIsReturned(t *testing.T) {
+	reg := NewApplyObserverRegistry()
+	obs := &fakeApplyObserver{err: errors.New("boom")}
+	reg.Register("required-one", obs, true)
+	a := newTestUberApplierForObservers(reg)
+
+	err := a.notifyApplyObservers(&pb.InternalRaftRequest{}, &applyResult{}, 1, 1)
+	if err == nil {
+		t.Fatal("a required observer's error should be returned to the caller, got nil")
+	}
+	if obs.called != 1 {
+		t.Fatalf("expected the observer to be invoked once, got %d", obs.called)
+	}
+}
+
+func TestNotifyApplyObserversAdvisoryObserverLogsAndContinues(t *testing.T) {
+	reg := NewApplyObserverRegistry()
+	failing := &fakeApplyObserver{err: errors.New("boom")}
+	following := &fakeApplyObserver{}
+	reg.Register("advisory-one", failing, false)
+	reg.Register("advisory-two", following, false)
+	a := newTestUberApplierForObservers(reg)
+
+	if err := a.notifyApplyObservers(&pb.InternalRaftRequest{}, &applyResult{}, 1, 1); err != nil {
+		t.Fatalf("an advisory observer's error should not block the apply, got %v", err)
+	}
+	if following.called != 1 {
+		t.Fatalf("a later observer should still run after an earlier advisory failure, got called=%d", following.called)
+	}
+}
+
+func TestNotifyApplyObserversSkipsAlreadyDeliveredIndex(t *testing.T) {
+	reg := NewApplyObserverRegistry()
+	obs := &fakeApplyObserver{}
+	reg.Register("resumed", obs, true)
+	a := newTestUberApplierForObservers(reg)
+	a.observerLastIndex["resumed"] = 5
+
+	if err := a.notifyApplyObservers(&pb.InternalRaftRequest{}, &applyResult{}, 3, 1); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if obs.called != 0 {
+		t.Fatalf("an index already delivered before a resume should be skipped, got called=%d", obs.called)
+	}
+
+	if err := a.notifyApplyObservers(&pb.InternalRaftRequest{}, &applyResult{}, 6, 1); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if obs.called != 1 {
+		t.Fatalf("an index past the resume point should be delivered, got called=%d", obs.called)
+	}
+}
+
+func TestNotifyApplyObserversNilRegistryIsNoop(t *testing.T) {
+	a := newTestUberApplierForObservers(nil)
+	if err := a.notifyApplyObservers(&pb.InternalRaftRequest{}, &applyResult{}, 1, 1); err != nil {
+		t.Fatalf("a nil registry should never error, got %v", err)
+	}
+}
+
+// newTestUberApplierWithBackend is newTestUberApplierForObservers but backed
+// by a real bbolt-backed backend.Backend, so loadObserverLastIndex exercises
+// the same UnsafeRange/UnsafePut path production code does instead of
+// always taking the a.be == nil shortcut.
+func newTestUberApplierWithBackend(registry *ApplyObserverRegistry, be backend.Backend) *uberApplier {
+	return &uberApplier{
+		lg:                zap.NewNop(),
+		be:                be,
+		observers:         registry,
+		observerLastIndex: make(map[string]uint64),
+	}
+}
+
+// TestNotifyApplyObserversResumesAcrossRestartFromPersistedIndex is the
+// regression test for the bug fixed alongside it: Apply used to always
+// thread raftIndex=0 through to notifyApplyObservers, which made its
+// "already delivered" skip check (raftIndex != 0 && raftIndex <= last)
+// permanently unreachable, so every restart replayed every observer from
+// scratch regardless of what had been persisted. This constructs two
+// uberAppliers against the *same* backend -- standing in for a process
+// restart, since a fresh uberApplier always starts with an empty in-memory
+// observerLastIndex cache and must fall back to the backend -- and checks
+// the second one resumes from the first one's last delivered index instead
+// of redelivering it.
+func TestNotifyApplyObserversResumesAcrossRestartFromPersistedIndex(t *testing.T) {
+	be, _ := betesting.NewDefaultTmpBackend(t)
+	defer betesting.Close(t, be)
+	tx := be.BatchTx()
+	tx.Lock()
+	tx.UnsafeCreateBucket(schema.Meta)
+	tx.Unlock()
+	be.ForceCommit()
+
+	before := &fakeApplyObserver{}
+	reg := NewApplyObserverRegistry()
+	reg.Register("durable", before, true)
+
+	firstRun := newTestUberApplierWithBackend(reg, be)
+	for _, idx := range []uint64{1, 2, 3} {
+		if err := firstRun.notifyApplyObservers(&pb.InternalRaftRequest{}, &applyResult{}, idx, 1); err != nil {
+			t.Fatalf("unexpected error delivering index %d: %v", idx, err)
+		}
+	}
+	if before.called != 3 {
+		t.Fatalf("expected 3 deliveries before the simulated restart, got %d", before.called)
+	}
+	be.ForceCommit()
+
+	after := &fakeApplyObserver{}
+	reg2 := NewApplyObserverRegistry()
+	reg2.Register("durable", after, true)
+	secondRun := newTestUberApplierWithBackend(reg2, be)
+
+	for _, idx := range []uint64{1, 2, 3} {
+		if err := secondRun.notifyApplyObservers(&pb.InternalRaftRequest{}, &applyResult{}, idx, 1); err != nil {
+			t.Fatalf("unexpected error replaying index %d: %v", idx, err)
+		}
+	}
+	if after.called != 0 {
+		t.Fatalf("a restarted uberApplier should not redeliver indices already persisted before the restart, got called=%d", after.called)
+	}
+
+	if err := secondRun.notifyApplyObservers(&pb.InternalRaftRequest{}, &applyResult{}, 4, 1); err != nil {
+		t.Fatalf("unexpected error delivering index 4: %v", err)
+	}
+	if after.called != 1 {
+		t.Fatalf("an index past the persisted resume point should still be delivered after a restart, got called=%d", after.called)
+	}
+
+	rtx := be.ReadTx()
+	rtx.RLock()
+	_, vs := rtx.UnsafeRange(schema.Meta, observerLastIndexKey("durable"), nil, 0)
+	rtx.RUnlock()
+	if len(vs) != 1 || string(vs[0]) != strconv.FormatUint(4, 10) {
+		t.Fatalf("expected the persisted index to be updated to 4, got %q", vs)
+	}
+}
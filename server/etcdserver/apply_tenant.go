@@ -0,0 +1,283 @@
+// Copyright 2022 The etcd Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package etcdserver
+
+import (
+	"bytes"
+	"context"
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	pb "go.etcd.io/etcd/api/v3/etcdserverpb"
+	"go.etcd.io/etcd/pkg/v3/traceutil"
+	"go.etcd.io/etcd/server/v3/storage/mvcc"
+)
+
+// TenantConfig declares one tenant partition: every key in [Prefix, end)
+// (end computed the same way clientv3/namespace derives range ends) is
+// routed to this tenant's own applierV3, quota and alarm state, instead of
+// the cluster-wide one. Cfg.Tenants holds the set configured at startup;
+// TenantRouter.AddTenant/RemoveTenant change the router's own partitions
+// and do not modify Cfg.Tenants.
+type TenantConfig struct {
+	Name   string
+	Prefix []byte
+	// QuotaBytes bounds how many Put/DeleteRange bytes this tenant may
+	// write before its own partition (and only its own partition) starts
+	// reporting NOSPACE. 0 means unbounded.
+	QuotaBytes int64
+	// AuthRealm names the auth store backing this tenant. Empty means the
+	// tenant shares the cluster-wide auth store.
+	AuthRealm string
+}
+
+// tenantPartition is the runtime state the TenantRouter keeps per
+// configured tenant: its own apply chain plus the capped/corrupt wrapping
+// RestoreAlarms layers on independently of every other tenant.
+type tenantPartition struct {
+	cfg TenantConfig
+
+	applyV3base applierV3
+	applyV3     applierV3
+
+	// usedBytes is this tenant's own view of quota usage -- the
+	// "AlarmStore view" the request asks for. It is scoped entirely to
+	// this partition, so tenant A crossing its QuotaBytes never raises
+	// NOSPACE for tenant B. Accessed atomically; accounted for by
+	// tenantQuotaApplierV3 on every successful Put/DeleteRange.
+	usedBytes int64
+}
+
+// noSpace reports whether this partition's own write volume has crossed
+// its configured QuotaBytes. A zero QuotaBytes means "unbounded", matching
+// the cluster-wide quota's own convention of 0 == no limit.
+func (p *tenantPartition) noSpace() bool {
+	return p.cfg.QuotaBytes > 0 && atomic.LoadInt64(&p.usedBytes) >= p.cfg.QuotaBytes
+}
+
+// tenantQuotaApplierV3 tallies the bytes a tenant partition writes so that
+// NOSPACE can be derived from that tenant's own usage instead of the
+// cluster-wide v3alarm.AlarmStore/backend size. It's intentionally simple
+// (key+value length, no backend overhead accounting) -- precise enough to
+// give each tenant independent backpressure without requiring the full
+// quota subsystem to be made tenant-aware.
+type tenantQuotaApplierV3 struct {
+	applierV3
+	used *int64
+}
+
+func newTenantQuotaApplierV3(next applierV3, used *int64) applierV3 {
+	return &tenantQuotaApplierV3{applierV3: next, used: used}
+}
+
+func (a *tenantQuotaApplierV3) Put(ctx context.Context, txn mvcc.TxnWrite, p *pb.PutRequest) (*pb.PutResponse, *traceutil.Trace, error) {
+	resp, trace, err := a.applierV3.Put(ctx, txn, p)
+	if err == nil {
+		atomic.AddInt64(a.used, int64(len(p.Key)+len(p.Value)))
+	}
+	return resp, trace, err
+}
+
+func (a *tenantQuotaApplierV3) DeleteRange(txn mvcc.TxnWrite, dr *pb.DeleteRangeRequest) (*pb.DeleteRangeResponse, error) {
+	resp, err := a.applierV3.DeleteRange(txn, dr)
+	if err == nil && resp != nil {
+		// Freed keys give some of the tenant's quota back, mirroring how
+		// the cluster-wide quota tracks backend size rather than a
+		// monotonic write counter.
+		atomic.AddInt64(a.used, -int64(len(dr.Key))*resp.Deleted)
+		if atomic.LoadInt64(a.used) < 0 {
+			atomic.StoreInt64(a.used, 0)
+		}
+	}
+	return resp, err
+}
+
+// TenantRouter inspects the key range of Range/Put/DeleteRange/Txn
+// requests and dispatches each one to the applierV3 belonging to the tenant
+// whose prefix contains it, falling back to the cluster-wide default
+// applier for keys that don't match any tenant. Compaction and LeaseGrant
+// are not routed: dispatch always sends them to the cluster-wide applier. This
+// lets one NOSPACE/CORRUPT alarm raised against tenant A's quota or backend
+// leave tenant B (and the default partition) writable.
+type TenantRouter struct {
+	mu sync.RWMutex
+
+	// default_ is used for keys that fall outside every configured tenant
+	// prefix, i.e. the applier uberApplier used before tenants existed.
+	default_ *tenantPartition
+
+	// partitions is kept sorted by Prefix. route still scans it linearly
+	// (the longest-prefix-match rule below means a binary search on this
+	// ordering alone wouldn't find the right partition any faster); the
+	// sort just makes that scan and restoreAlarms's iteration order
+	// deterministic. Tenant prefixes are expected to number in the tens,
+	// not thousands, so the scan cost isn't a concern in practice.
+	partitions []*tenantPartition
+}
+
+func newTenantRouter(defaultApplyV3 applierV3) *TenantRouter {
+	return &TenantRouter{
+		default_: &tenantPartition{applyV3base: defaultApplyV3, applyV3: defaultApplyV3},
+	}
+}
+
+// AddTenant registers a new tenant partition, building it a fresh applier
+// chain rooted at newApply plus its own quota accounting. newUberApplier
+// calls it once for each ServerConfig.Tenants entry; no raft request calls
+// it, since (*EtcdServer).TenantAdd in tenant_rpc.go returns
+// ErrTenantAdminNotImplemented.
+func (tr *TenantRouter) AddTenant(cfg TenantConfig, newApply applierV3) {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	p := &tenantPartition{cfg: cfg}
+	p.applyV3base = newTenantQuotaApplierV3(newApply, &p.usedBytes)
+	p.applyV3 = p.applyV3base
+	tr.partitions = append(tr.partitions, p)
+	sort.Slice(tr.partitions, func(i, j int) bool {
+		return bytes.Compare(tr.partitions[i].cfg.Prefix, tr.partitions[j].cfg.Prefix) < 0
+	})
+}
+
+// RemoveTenant drops a tenant partition by name; keys previously routed to
+// it fall back to the default partition.
+func (tr *TenantRouter) RemoveTenant(name string) {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	for i, p := range tr.partitions {
+		if p.cfg.Name == name {
+			tr.partitions = append(tr.partitions[:i], tr.partitions[i+1:]...)
+			return
+		}
+	}
+}
+
+// route returns the partition owning key, or the default partition if no
+// tenant prefix contains it. When more than one configured prefix contains
+// key -- tenant prefixes are expected to be mutually exclusive, but nothing
+// stops an operator from registering overlapping ones, e.g. "/a" and
+// "/ab" both containing "/abc" -- route picks the longest matching prefix,
+// the same most-specific-wins rule a routing table or ACL would use, so the
+// more specific tenant's quota/auth isolation isn't silently bypassed by an
+// overlapping, less specific registration.
+func (tr *TenantRouter) route(key []byte) *tenantPartition {
+	tr.mu.RLock()
+	defer tr.mu.RUnlock()
+	var best *tenantPartition
+	for _, p := range tr.partitions {
+		if !bytes.HasPrefix(key, p.cfg.Prefix) {
+			continue
+		}
+		if best == nil || len(p.cfg.Prefix) > len(best.cfg.Prefix) {
+			best = p
+		}
+	}
+	if best != nil {
+		return best
+	}
+	return tr.default_
+}
+
+// applierFor picks the applier for a request carrying a single key/range
+// start. Callers that can name multiple keys (Txn) should resolve a single
+// representative key via keyOf/txnKey first so the request lands on the
+// applier that owns that key's quota/auth, rather than silently falling
+// back to the default partition. The whole Txn goes to that one applier,
+// including sub-operations whose keys belong to another tenant.
+func (tr *TenantRouter) applierFor(key []byte) applierV3 {
+	return tr.route(key).applyV3
+}
+
+// restoreAlarms re-derives every partition's wrapping from its own NOSPACE
+// state (tenantPartition.noSpace, scoped to that tenant's own QuotaBytes
+// usage -- see tenantQuotaApplierV3) independently of every other
+// partition, so a NOSPACE alarm raised against tenant A's quota never wraps
+// (and therefore never rejects writes for) tenant B or the default
+// partition. wrap is handed each partition's noSpace/corrupt state and
+// returns the applier RestoreAlarms should install for it -- shared with
+// uberApplier.RestoreAlarms so both the default applier and every tenant
+// apply the exact same capped/throttled/corrupt decision.
+//
+// corrupt is still the single cluster-wide v3alarm.AlarmStore CORRUPT flag:
+// this tree has no tenant-scoped corruption detector, so a CORRUPT alarm
+// still wraps every partition. That is a real, intentional limitation,
+// not an oversight -- backend corruption isn't confined to a key range.
+func (tr *TenantRouter) restoreAlarms(corrupt bool, wrap func(base applierV3, noSpace, corrupt bool) applierV3) {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	for _, p := range append([]*tenantPartition{tr.default_}, tr.partitions...) {
+		p.applyV3 = wrap(p.applyV3base, p.noSpace(), corrupt)
+	}
+}
+
+// keyOf extracts the routing key for the request kinds TenantRouter cares
+// about; it returns nil for everything else, which routes to the default
+// partition.
+func keyOf(r *pb.InternalRaftRequest) []byte {
+	switch {
+	case r.Range != nil:
+		return r.Range.Key
+	case r.Put != nil:
+		return r.Put.Key
+	case r.DeleteRange != nil:
+		return r.DeleteRange.Key
+	case r.Txn != nil:
+		return txnKey(r.Txn)
+	}
+	return nil
+}
+
+// txnKey finds a representative routing key inside a TxnRequest. Most
+// Txns from client libraries (compare-and-swap, STM, concurrency/stm) carry
+// a Compare clause, but plain multi-op writes built with clientv3.Txn's
+// Then()/Else() with no If() -- a common fire-and-forget batched-write
+// pattern -- have none. Falling back to Compare alone routed every
+// Compare-less Txn to the default partition, letting a tenant dodge its own
+// quota/auth by wrapping Puts in a bodyless Txn; so this also walks
+// Success/Failure looking for the first keyed sub-operation.
+func txnKey(t *pb.TxnRequest) []byte {
+	for _, c := range t.Compare {
+		if len(c.Key) > 0 {
+			return c.Key
+		}
+	}
+	if k := requestOpsKey(t.Success); len(k) > 0 {
+		return k
+	}
+	return requestOpsKey(t.Failure)
+}
+
+func requestOpsKey(ops []*pb.RequestOp) []byte {
+	for _, op := range ops {
+		if k := requestOpKey(op); len(k) > 0 {
+			return k
+		}
+	}
+	return nil
+}
+
+func requestOpKey(op *pb.RequestOp) []byte {
+	switch o := op.Request.(type) {
+	case *pb.RequestOp_RequestRange:
+		return o.RequestRange.Key
+	case *pb.RequestOp_RequestPut:
+		return o.RequestPut.Key
+	case *pb.RequestOp_RequestDeleteRange:
+		return o.RequestDeleteRange.Key
+	case *pb.RequestOp_RequestTxn:
+		return txnKey(o.RequestTxn)
+	}
+	return nil
+}
@@ -0,0 +1,120 @@
+// Copyright 2022 The etcd Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package etcdserver
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	pb "go.etcd.io/etcd/api/v3/etcdserverpb"
+	"go.etcd.io/etcd/pkg/v3/traceutil"
+	"go.etcd.io/etcd/server/v3/storage/mvcc"
+	"go.uber.org/zap"
+	"golang.org/x/time/rate"
+)
+
+func TestApplyThrottleAdmitShedsOnceBucketIsEmpty(t *testing.T) {
+	gate := newApplyThrottle(zap.NewNop(), ThrottlePolicy{
+		Enabled: true,
+		Buckets: map[ThrottlePriority]ThrottleBucketPolicy{
+			ThrottlePriorityBulk: {Rate: rate.Every(time.Hour), Burst: 1},
+		},
+	})
+
+	if err := gate.Admit("Put"); err != nil {
+		t.Fatalf("first Put should be admitted from a fresh burst-1 bucket, got %v", err)
+	}
+	if err := gate.Admit("Put"); !errors.Is(err, ErrThrottled) {
+		t.Fatalf("second Put should be shed once the bucket is empty, got %v", err)
+	}
+	if err := gate.Admit("AuthEnable"); err != nil {
+		t.Fatalf("AuthEnable has no configured bucket and should never be shed, got %v", err)
+	}
+}
+
+func TestApplierV3ThrottledShedsBulkTxnWithNoCompareClause(t *testing.T) {
+	gate := newApplyThrottle(zap.NewNop(), ThrottlePolicy{
+		Enabled: true,
+		Buckets: map[ThrottlePriority]ThrottleBucketPolicy{
+			ThrottlePriorityBulk: {Rate: rate.Every(time.Hour), Burst: 0},
+		},
+	})
+	applier := newApplierV3Throttled(&fakeApplierV3{}, gate)
+
+	txn := &pb.TxnRequest{
+		Success: []*pb.RequestOp{
+			{Request: &pb.RequestOp_RequestPut{RequestPut: &pb.PutRequest{Key: []byte("k")}}},
+		},
+	}
+
+	_, _, err := applier.(*applierV3Throttled).Txn(context.Background(), txn)
+	if !errors.Is(err, ErrThrottled) {
+		t.Fatalf("a Txn made entirely of Puts should be shed like a bare Put, got %v", err)
+	}
+}
+
+func TestApplierV3ThrottledDoesNotShedCompareTxn(t *testing.T) {
+	gate := newApplyThrottle(zap.NewNop(), ThrottlePolicy{
+		Enabled: true,
+		Buckets: map[ThrottlePriority]ThrottleBucketPolicy{
+			ThrottlePriorityBulk: {Rate: rate.Every(time.Hour), Burst: 0},
+		},
+	})
+	applier := newApplierV3Throttled(&fakeApplierV3{}, gate)
+
+	txn := &pb.TxnRequest{
+		Compare: []*pb.Compare{{Key: []byte("k")}},
+		Success: []*pb.RequestOp{
+			{Request: &pb.RequestOp_RequestPut{RequestPut: &pb.PutRequest{Key: []byte("k")}}},
+		},
+	}
+
+	if _, _, err := applier.(*applierV3Throttled).Txn(context.Background(), txn); err != nil {
+		t.Fatalf("a CAS-style Txn falls under ThrottlePriorityNormal (no configured bucket), got %v", err)
+	}
+}
+
+// Txn, DeleteRange and UserAdd round out fakeApplierV3 so applierV3Throttled
+// tests can exercise the admitted path.
+func (f *fakeApplierV3) Txn(ctx context.Context, rt *pb.TxnRequest) (*pb.TxnResponse, *traceutil.Trace, error) {
+	return &pb.TxnResponse{}, nil, nil
+}
+
+func (f *fakeApplierV3) DeleteRange(txn mvcc.TxnWrite, dr *pb.DeleteRangeRequest) (*pb.DeleteRangeResponse, error) {
+	return &pb.DeleteRangeResponse{}, nil
+}
+
+func (f *fakeApplierV3) UserAdd(r *pb.AuthUserAddRequest) (*pb.AuthUserAddResponse, error) {
+	return &pb.AuthUserAddResponse{}, nil
+}
+
+func TestApplierV3ThrottledShedsAuthTraffic(t *testing.T) {
+	gate := newApplyThrottle(zap.NewNop(), ThrottlePolicy{
+		Enabled: true,
+		Buckets: map[ThrottlePriority]ThrottleBucketPolicy{
+			ThrottlePriorityAuth: {Rate: rate.Every(time.Hour), Burst: 1},
+		},
+	})
+	applier := newApplierV3Throttled(&fakeApplierV3{}, gate).(*applierV3Throttled)
+
+	if _, err := applier.UserAdd(&pb.AuthUserAddRequest{Name: "u"}); err != nil {
+		t.Fatalf("first AuthUserAdd should be admitted from a fresh burst-1 bucket, got %v", err)
+	}
+	if _, err := applier.UserAdd(&pb.AuthUserAddRequest{Name: "u"}); !errors.Is(err, ErrThrottled) {
+		t.Fatalf("second AuthUserAdd should be shed once the auth bucket is empty, got %v", err)
+	}
+}
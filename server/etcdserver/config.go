@@ -0,0 +1,49 @@
+// Copyright 2022 The etcd Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package etcdserver
+
+import "time"
+
+// ServerConfig is EtcdServer.Cfg. This tree only carries the subset of
+// fields the apply-path files read; WarningApplyDuration already existed
+// upstream, Tenants is the field the apply_tenant.go TenantRouter needs.
+type ServerConfig struct {
+	WarningApplyDuration time.Duration
+
+	// Tenants declares the namespace partitions uberApplier.tenants routes
+	// keyed requests to at startup; newUberApplier reads it once. There is
+	// no runtime change to the tenant set: (*EtcdServer).TenantAdd/
+	// TenantRemove (tenant_rpc.go) return ErrTenantAdminNotImplemented.
+	Tenants []TenantConfig
+
+	// Throttle configures applierV3Throttled, the cooperative
+	// backpressure-shedding mode RestoreAlarms swaps in under NOSPACE
+	// instead of applierV3Capped when Throttle.Enabled is set.
+	Throttle ThrottlePolicy
+
+	// ApplyObservers is this server's ApplyObserver chain. Nil (the
+	// default) means no observers run; set it to a *ApplyObserverRegistry
+	// built with NewApplyObserverRegistry and populated via Register before
+	// constructing the EtcdServer that should use it.
+	ApplyObservers *ApplyObserverRegistry
+
+	// ApplierMiddlewares is this server's ApplierMiddlewareFactory chain.
+	// Nil (the default) means no middlewares run; set it to a
+	// *ApplierMiddlewareRegistry built with NewApplierMiddlewareRegistry
+	// and populated via Register before constructing the EtcdServer that
+	// should use it. See apply_otel.go's newOtelApplierV3/
+	// newAuthAuditApplierV3 for the built-in factories.
+	ApplierMiddlewares *ApplierMiddlewareRegistry
+}
@@ -17,11 +17,13 @@ package etcdserver
 import (
 	"context"
 	"strconv"
+	"sync"
 	"time"
 
 	pb "go.etcd.io/etcd/api/v3/etcdserverpb"
 	"go.etcd.io/etcd/server/v3/etcdserver/api/membership"
 	"go.etcd.io/etcd/server/v3/etcdserver/api/v3alarm"
+	"go.etcd.io/etcd/server/v3/storage/backend"
 	"go.etcd.io/etcd/server/v3/storage/mvcc"
 	"go.uber.org/zap"
 )
@@ -42,6 +44,44 @@ type uberApplier struct {
 	// (that seems to bypass wrappings)
 	// TODO(ptab): Seems artificial and could be part of the regular stack.
 	applyV3Internal applierV3Internal
+
+	// tenants routes keyed requests to a per-tenant applier/quota/alarm
+	// partition when EtcdServer.Cfg.Tenants declares any; it always has at
+	// least a default partition backed by applyV3base.
+	tenants *TenantRouter
+
+	// be is the backend notifyApplyObservers persists each ApplyObserver's
+	// last-delivered index to, and loadObserverLastIndex reads it back from
+	// on resume; see notifyApplyObservers for why this is a separate
+	// critical section from the apply's own backend write.
+	be backend.Backend
+
+	// observers is this server's ApplyObserver chain. It comes from
+	// Cfg.ApplyObservers rather than a package-level registry so that
+	// constructing more than one EtcdServer in a process never shares
+	// registrations across them; nil means no observers are registered.
+	observers *ApplyObserverRegistry
+
+	// observerMu guards observerLastIndex, the in-memory cache of each
+	// observer's last-delivered index populated lazily (on first use, from
+	// the backend) by notifyApplyObservers.
+	observerMu        sync.Mutex
+	observerLastIndex map[string]uint64
+
+	// curRaftIndex/curRaftTerm are set by Apply for the request currently
+	// flowing through dispatch, so notifyApplyObservers can hand them to
+	// registered ApplyObservers without changing the applierV3.WrapApply
+	// callback signature.
+	curRaftIndex uint64
+	curRaftTerm  uint64
+
+	// throttlePolicy/throttleGate back applierV3Throttled, which
+	// wrapForAlarms swaps in instead of applierV3Capped under NOSPACE when
+	// Cfg.Throttle.Enabled; see EtcdServer.Cfg.Throttle. throttleGate is
+	// shared by every partition's applierV3Throttled so all of them draw
+	// from the same token buckets.
+	throttlePolicy ThrottlePolicy
+	throttleGate   *applyThrottle
 }
 
 func newUberApplier(s *EtcdServer) *uberApplier {
@@ -54,6 +94,15 @@ func newUberApplier(s *EtcdServer) *uberApplier {
 		applyV3:              applyV3base_,
 		applyV3base:          applyV3base_,
 		applyV3Internal:      newApplierV3Internal(s),
+		tenants:              newTenantRouter(applyV3base_),
+		be:                   s.be,
+		observers:            s.Cfg.ApplyObservers,
+		observerLastIndex:    make(map[string]uint64),
+		throttlePolicy:       s.Cfg.Throttle,
+		throttleGate:         newApplyThrottle(s.lg, s.Cfg.Throttle),
+	}
+	for _, tc := range s.Cfg.Tenants {
+		ua.tenants.AddTenant(tc, newApplierV3(s))
 	}
 	ua.RestoreAlarms()
 	return ua
@@ -71,7 +120,7 @@ func newApplierV3Internal(s *EtcdServer) applierV3Internal {
 func newApplierV3(s *EtcdServer) applierV3 {
 	return newAuthApplierV3(
 		s.AuthStore(),
-		newQuotaApplierV3(s, newApplierV3Backend(s)),
+		newQuotaApplierV3(s, s.Cfg.ApplierMiddlewares.wrap(newApplierV3Backend(s))),
 		s.lessor,
 	)
 }
@@ -79,16 +128,55 @@ func newApplierV3(s *EtcdServer) applierV3 {
 func (a *uberApplier) RestoreAlarms() {
 	noSpaceAlarms := len(a.alarmStore.Get(pb.AlarmType_NOSPACE)) > 0
 	corruptAlarms := len(a.alarmStore.Get(pb.AlarmType_CORRUPT)) > 0
-	a.applyV3 = a.applyV3base
-	if noSpaceAlarms {
-		a.applyV3 = newApplierV3Capped(a.applyV3)
+	a.applyV3 = a.wrapForAlarms(a.applyV3base, noSpaceAlarms, corruptAlarms)
+
+	// Every tenant partition gets its own noSpace/corrupt decision through
+	// the same wrapForAlarms logic used above: noSpace comes from that
+	// partition's own quota usage (tenantPartition.noSpace), not the
+	// cluster-wide flag, so a NOSPACE alarm scoped to tenant A's quota
+	// doesn't wrap tenant B. corrupt is still the cluster-wide CORRUPT flag
+	// -- see the doc comment on TenantRouter.restoreAlarms for why.
+	a.tenants.restoreAlarms(corruptAlarms, a.wrapForAlarms)
+
+	// The default partition has no quota of its own, so keys outside every
+	// tenant prefix keep the cluster-wide NOSPACE/CORRUPT wrapping.
+	a.tenants.mu.Lock()
+	a.tenants.default_.applyV3 = a.applyV3
+	a.tenants.mu.Unlock()
+}
+
+// wrapForAlarms applies the same noSpace/corrupt wrapping decision
+// RestoreAlarms has always made for the default applier to any applierV3,
+// so tenant partitions can reuse it verbatim instead of re-implementing it.
+// Under NOSPACE, this picks applierV3Throttled over the hard-rejecting
+// applierV3Capped when Cfg.Throttle.Enabled -- that's the whole point of
+// the throttle feature: replace outright rejection with cooperative
+// shedding, not add a second, always-on rate limiter next to it.
+func (a *uberApplier) wrapForAlarms(base applierV3, noSpace, corrupt bool) applierV3 {
+	applied := base
+	switch {
+	case noSpace && a.throttlePolicy.Enabled:
+		applied = newApplierV3Throttled(applied, a.throttleGate)
+	case noSpace:
+		applied = newApplierV3Capped(applied)
 	}
-	if corruptAlarms {
-		a.applyV3 = newApplierV3Corrupt(a.applyV3)
+	if corrupt {
+		applied = newApplierV3Corrupt(applied)
 	}
+	return applied
 }
 
-func (a *uberApplier) Apply(r *pb.InternalRaftRequest, shouldApplyV3 membership.ShouldApplyV3) *applyResult {
+// Apply dispatches r, which must already be the request committed at
+// raftIndex/raftTerm -- the apply loop (etcdserver/apply.Apply upstream;
+// not part of this tree) is expected to pass the *raftpb.Entry's own
+// Index/Term here, the same values it reads off the committed entry before
+// ever reaching this package. There is deliberately no index-less
+// convenience wrapper: notifyApplyObservers' resume/dedup check
+// (apply_observer.go) only does anything useful when raftIndex is the real
+// committed index, and a silent `0, 0` default previously made that check
+// permanently unreachable.
+func (a *uberApplier) Apply(r *pb.InternalRaftRequest, shouldApplyV3 membership.ShouldApplyV3, raftIndex, raftTerm uint64) *applyResult {
+	a.curRaftIndex, a.curRaftTerm = raftIndex, raftTerm
 	return a.applyV3.WrapApply(context.TODO(), r, shouldApplyV3, a.dispatch)
 }
 
@@ -128,17 +216,20 @@ func (a *uberApplier) dispatch(ctx context.Context, r *pb.InternalRaftRequest, s
 	switch {
 	case r.Range != nil:
 		op = "Range"
-		ar.resp, ar.err = a.applyV3.Range(ctx, nil, r.Range)
+		ar.resp, ar.err = a.tenants.applierFor(r.Range.Key).Range(ctx, nil, r.Range)
 	case r.Put != nil:
 		op = "Put"
-		ar.resp, ar.trace, ar.err = a.applyV3.Put(ctx, nil, r.Put)
+		ar.resp, ar.trace, ar.err = a.tenants.applierFor(r.Put.Key).Put(ctx, nil, r.Put)
 	case r.DeleteRange != nil:
 		op = "DeleteRange"
-		ar.resp, ar.err = a.applyV3.DeleteRange(nil, r.DeleteRange)
+		ar.resp, ar.err = a.tenants.applierFor(r.DeleteRange.Key).DeleteRange(nil, r.DeleteRange)
 	case r.Txn != nil:
 		op = "Txn"
-		ar.resp, ar.trace, ar.err = a.applyV3.Txn(ctx, r.Txn)
+		ar.resp, ar.trace, ar.err = a.tenants.applierFor(keyOf(r)).Txn(ctx, r.Txn)
 	case r.Compaction != nil:
+		// Compaction and LeaseGrant carry no key/prefix to route on, so
+		// they stay on the default partition until TenantConfig grows an
+		// explicit tenant ID for these request types.
 		op = "Compaction"
 		ar.resp, ar.physc, ar.trace, ar.err = a.applyV3.Compaction(r.Compaction)
 	case r.LeaseGrant != nil:
@@ -206,6 +297,10 @@ func (a *uberApplier) dispatch(ctx context.Context, r *pb.InternalRaftRequest, s
 	default:
 		a.lg.Panic("not implemented apply", zap.Stringer("raft-request", r))
 	}
+
+	if err := a.notifyApplyObservers(r, ar, a.curRaftIndex, a.curRaftTerm); err != nil && ar.err == nil {
+		ar.err = err
+	}
 	return ar
 }
 